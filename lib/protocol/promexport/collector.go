@@ -0,0 +1,116 @@
+// Copyright (C) 2014 The Protocol Authors.
+
+// Package promexport exposes per-connection protocol.Statistics as
+// Prometheus metrics, so operators can scrape per-peer traffic,
+// compression, and latency data.
+package promexport
+
+import (
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/syncthing/syncthing/lib/protocol"
+)
+
+// Collector implements prometheus.Collector over a set of connections,
+// keyed by device ID. Register it once with prometheus.Register and call
+// Add/Remove as devices connect and disconnect.
+type Collector struct {
+	mut         sync.Mutex
+	connections map[protocol.DeviceID]protocol.Connection
+
+	inBytes, outBytes          *prometheus.Desc
+	sentBytes, recvBytes       *prometheus.Desc
+	sentMessages, recvMessages *prometheus.Desc
+	compressionRatio           *prometheus.Desc
+	outboxDepth                *prometheus.Desc
+	inFlightRequests           *prometheus.Desc
+	rttSeconds                 *prometheus.Desc
+	decompressionErrors        *prometheus.Desc
+}
+
+// New creates a Collector with no connections registered yet.
+func New() *Collector {
+	return &Collector{
+		connections: make(map[protocol.DeviceID]protocol.Connection),
+
+		inBytes:  prometheus.NewDesc("syncthing_connection_in_bytes_total", "Total bytes received on a connection.", []string{"device"}, nil),
+		outBytes: prometheus.NewDesc("syncthing_connection_out_bytes_total", "Total bytes sent on a connection.", []string{"device"}, nil),
+
+		sentBytes: prometheus.NewDesc("syncthing_connection_sent_bytes_total", "Bytes sent, broken down by message type.", []string{"device", "type"}, nil),
+		recvBytes: prometheus.NewDesc("syncthing_connection_received_bytes_total", "Bytes received, broken down by message type.", []string{"device", "type"}, nil),
+
+		sentMessages: prometheus.NewDesc("syncthing_connection_sent_messages_total", "Messages sent, broken down by message type.", []string{"device", "type"}, nil),
+		recvMessages: prometheus.NewDesc("syncthing_connection_received_messages_total", "Messages received, broken down by message type.", []string{"device", "type"}, nil),
+
+		compressionRatio:    prometheus.NewDesc("syncthing_connection_compression_ratio", "Ratio of uncompressed to compressed bytes sent.", []string{"device"}, nil),
+		outboxDepth:         prometheus.NewDesc("syncthing_connection_outbox_depth", "Messages currently queued to be written.", []string{"device"}, nil),
+		inFlightRequests:    prometheus.NewDesc("syncthing_connection_in_flight_requests", "Requests sent that are still awaiting a Response.", []string{"device"}, nil),
+		rttSeconds:          prometheus.NewDesc("syncthing_connection_rtt_seconds", "Moving average round-trip time derived from Ping/Pong.", []string{"device"}, nil),
+		decompressionErrors: prometheus.NewDesc("syncthing_connection_decompression_errors_total", "Messages that failed to decompress.", []string{"device"}, nil),
+	}
+}
+
+// Add registers a connection to be scraped under its device ID, replacing
+// any previous connection registered for that device.
+func (c *Collector) Add(conn protocol.Connection) {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	c.connections[conn.ID()] = conn
+}
+
+// Remove stops scraping the connection for the given device, typically
+// called from Model.Closed once a connection goes away.
+func (c *Collector) Remove(device protocol.DeviceID) {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	delete(c.connections, device)
+}
+
+func (c *Collector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.inBytes
+	ch <- c.outBytes
+	ch <- c.sentBytes
+	ch <- c.recvBytes
+	ch <- c.sentMessages
+	ch <- c.recvMessages
+	ch <- c.compressionRatio
+	ch <- c.outboxDepth
+	ch <- c.inFlightRequests
+	ch <- c.rttSeconds
+	ch <- c.decompressionErrors
+}
+
+func (c *Collector) Collect(ch chan<- prometheus.Metric) {
+	c.mut.Lock()
+	conns := make(map[protocol.DeviceID]protocol.Connection, len(c.connections))
+	for id, conn := range c.connections {
+		conns[id] = conn
+	}
+	c.mut.Unlock()
+
+	for id, conn := range conns {
+		device := id.String()
+		stats := conn.Statistics()
+
+		ch <- prometheus.MustNewConstMetric(c.inBytes, prometheus.CounterValue, float64(stats.InBytesTotal), device)
+		ch <- prometheus.MustNewConstMetric(c.outBytes, prometheus.CounterValue, float64(stats.OutBytesTotal), device)
+		ch <- prometheus.MustNewConstMetric(c.compressionRatio, prometheus.GaugeValue, stats.CompressionRatio, device)
+		ch <- prometheus.MustNewConstMetric(c.outboxDepth, prometheus.GaugeValue, float64(stats.OutboxDepth), device)
+		ch <- prometheus.MustNewConstMetric(c.inFlightRequests, prometheus.GaugeValue, float64(stats.InFlightRequests), device)
+		ch <- prometheus.MustNewConstMetric(c.rttSeconds, prometheus.GaugeValue, stats.RTT.Seconds(), device)
+		ch <- prometheus.MustNewConstMetric(c.decompressionErrors, prometheus.CounterValue, float64(stats.DecompressionErrors), device)
+
+		for t, s := range stats.Sent {
+			ch <- prometheus.MustNewConstMetric(c.sentBytes, prometheus.CounterValue, float64(s.Bytes), device, t.String())
+			ch <- prometheus.MustNewConstMetric(c.sentMessages, prometheus.CounterValue, float64(s.Count), device, t.String())
+		}
+		for t, s := range stats.Received {
+			ch <- prometheus.MustNewConstMetric(c.recvBytes, prometheus.CounterValue, float64(s.Bytes), device, t.String())
+			ch <- prometheus.MustNewConstMetric(c.recvMessages, prometheus.CounterValue, float64(s.Count), device, t.String())
+		}
+	}
+}
+
+var _ prometheus.Collector = (*Collector)(nil)
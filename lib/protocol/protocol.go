@@ -3,6 +3,8 @@
 package protocol
 
 import (
+	"bytes"
+	"context"
 	"crypto/sha256"
 	"encoding/binary"
 	"errors"
@@ -11,9 +13,13 @@ import (
 	"path"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	lz4 "github.com/bkaradzic/go-lz4"
+	"github.com/golang/snappy"
+	zstd "github.com/klauspost/compress/zstd"
+	"golang.org/x/time/rate"
 )
 
 const (
@@ -73,6 +79,44 @@ const (
 	FlagFromTemporary uint32 = 1 << iota
 )
 
+// Response message flags
+const (
+	// ResponseMoreComing is set on a Response when the block it carries has
+	// been split into several chunks sharing the same ID; the receiver
+	// should keep buffering chunks for that ID until one arrives without
+	// this flag set. Only used when both peers advertise
+	// CapabilityChunkedResponse.
+	ResponseMoreComing uint32 = 1 << iota
+)
+
+// Capabilities bits, advertised by each side in ClusterConfig.Capabilities.
+// A protocol extension gated on one of these bits must keep working,
+// falling back to the original behaviour, when talking to a peer that
+// doesn't set it.
+const (
+	// CapabilityChunkedResponse indicates support for receiving a Response
+	// split across multiple chunks, see ResponseMoreComing.
+	CapabilityChunkedResponse uint32 = 1 << iota
+	// CapabilityRequestCancel indicates support for cancelling an in-flight
+	// Request by sending a RequestCancel for its ID.
+	CapabilityRequestCancel
+	// CapabilityPingRTT indicates support for the Ping/Pong nonce exchange
+	// used to measure round-trip time, see Statistics.RTT.
+	CapabilityPingRTT
+)
+
+// supportedCapabilities is the bitmask of Capabilities bits this
+// implementation understands. It's ANDed with the peer's advertised bits
+// after ClusterConfig exchange to get the capabilities actually usable on a
+// given connection.
+const supportedCapabilities = CapabilityChunkedResponse | CapabilityRequestCancel | CapabilityPingRTT
+
+// responseChunkSize bounds the size of a single chunk when a Response is
+// streamed in multiple frames. Keeping frames well under MaxMessageLen lets
+// the writer interleave other messages between chunks of a large block
+// instead of blocking on one huge frame.
+const responseChunkSize = 1 << MiB
+
 // ClusterConfigMessage.Folders flags
 const (
 	FlagFolderReadOnly            uint32 = 1 << 0
@@ -108,6 +152,14 @@ const (
 	LocalAllFlags = FlagLocalUnsupported | FlagLocalIgnored | FlagLocalMustRescan | FlagLocalReceiveOnly
 )
 
+// Additional Header.Compression values beyond the original MessageCompressionNone
+// and MessageCompressionLZ4. A codec for each of these must be registered with
+// RegisterCodec before it can be negotiated with a peer.
+const (
+	MessageCompressionZstd   MessageCompression = 2
+	MessageCompressionSnappy MessageCompression = 3
+)
+
 var (
 	ErrClosed               = errors.New("connection closed")
 	ErrTimeout              = errors.New("read timeout")
@@ -125,8 +177,11 @@ type Model interface {
 	Index(deviceID DeviceID, folder string, files []FileInfo)
 	// An index update was received from the peer device
 	IndexUpdate(deviceID DeviceID, folder string, files []FileInfo)
-	// A request was made by the peer device
-	Request(deviceID DeviceID, folder, name string, size int32, offset int64, hash []byte, weakHash uint32, fromTemporary bool) (RequestResponse, error)
+	// A request was made by the peer device. The context is cancelled if
+	// the peer cancels the request (requires CapabilityRequestCancel on
+	// both sides) or the connection is closed; implementations should stop
+	// reading/hashing the block and return promptly when it's done.
+	Request(ctx context.Context, deviceID DeviceID, folder, name string, size int32, offset int64, hash []byte, weakHash uint32, fromTemporary bool) (RequestResponse, error)
 	// A cluster configuration message was received
 	ClusterConfig(deviceID DeviceID, config ClusterConfig)
 	// The peer device closed the connection
@@ -148,10 +203,15 @@ type Connection interface {
 	Index(folder string, files []FileInfo) error
 	IndexUpdate(folder string, files []FileInfo) error
 	Request(folder string, name string, offset int64, size int, hash []byte, weakHash uint32, fromTemporary bool) ([]byte, error)
+	RequestContext(ctx context.Context, folder string, name string, offset int64, size int, hash []byte, weakHash uint32, fromTemporary bool) ([]byte, error)
 	ClusterConfig(config ClusterConfig)
 	DownloadProgress(folder string, updates []FileDownloadProgressUpdate)
 	Statistics() Statistics
 	Closed() bool
+	// SetRateLimits installs token-bucket rate limiters bounding how fast
+	// this connection may send and receive bytes on the wire. Either may
+	// be nil to leave that direction unlimited.
+	SetRateLimits(send, recv *rate.Limiter)
 }
 
 type rawConnection struct {
@@ -170,10 +230,175 @@ type rawConnection struct {
 	nextID    int32
 	nextIDMut sync.Mutex
 
-	outbox      chan asyncMessage
+	// outbox holds one channel per messageClass; writerLoop schedules
+	// across them with weighted fair queueing, see outboxWeights.
+	outbox       [numMessageClasses]chan asyncMessage
+	classCredits [numMessageClasses]int
+
 	closed      chan struct{}
 	once        sync.Once
 	compression Compression
+
+	// sendLimiter and recvLimiter optionally bound how fast this connection
+	// may write and read bytes on the wire, set via SetRateLimits. Either
+	// may be nil for no limit.
+	limiterMut  sync.Mutex
+	sendLimiter *rate.Limiter
+	recvLimiter *rate.Limiter
+
+	// codecPriority is the locally preferred order of compression codecs,
+	// advertised to the peer in ClusterConfig. codec is the one actually
+	// negotiated for use on outgoing messages, defaulting to LZ4 (the only
+	// codec old peers are guaranteed to understand) until negotiation
+	// completes.
+	codecPriority []MessageCompression
+	codecMut      sync.Mutex
+	codec         Codec
+
+	// capabilities holds the peer's ClusterConfig.Capabilities bits, ANDed
+	// with supportedCapabilities, once negotiated. Accessed atomically as
+	// it's read by the reader goroutine and written after ClusterConfig.
+	capabilities uint32
+
+	// assembling holds in-progress chunked Response reassembly, keyed by
+	// request ID, for responses still waiting on their ResponseMoreComing
+	// chunks.
+	assemblingMut sync.Mutex
+	assembling    map[int32]*bytes.Buffer
+
+	// handling holds the cancel funcs for Requests we're currently
+	// answering, keyed by request ID, so an incoming RequestCancel can stop
+	// the in-progress Model.Request call.
+	handlingMut sync.Mutex
+	handling    map[int32]context.CancelFunc
+
+	// outboxDepth tracks the number of messages currently queued in
+	// c.outbox, across all classes, for Statistics().
+	outboxDepth int64 // atomic
+
+	sentStats, recvStats            *directionStats
+	compressedBytesOut, rawBytesOut int64 // atomic, for Statistics().CompressionRatio
+	decompressionErrors             int64 // atomic
+
+	// rttMut guards rtt and pendingPings, used to measure round-trip time
+	// via the Ping/Pong nonce exchange when CapabilityPingRTT is
+	// negotiated.
+	rttMut       sync.Mutex
+	rtt          time.Duration
+	pendingPings map[int64]time.Time
+	pingNonce    int64 // atomic
+}
+
+// Codec implements a single message compression algorithm. Implementations
+// are looked up by the Header.Compression value they report from ID(), so
+// that value must be stable and unique across registered codecs.
+type Codec interface {
+	ID() MessageCompression
+	Name() string
+	Encode(src []byte) ([]byte, error)
+	Decode(src []byte) ([]byte, error)
+}
+
+var (
+	codecsMut sync.RWMutex
+	codecs    = make(map[MessageCompression]Codec)
+)
+
+// RegisterCodec makes a compression codec available for negotiation with
+// peers. It is typically called from an init function; registering the same
+// ID twice replaces the previous codec.
+func RegisterCodec(c Codec) {
+	codecsMut.Lock()
+	defer codecsMut.Unlock()
+	codecs[c.ID()] = c
+}
+
+func getCodec(id MessageCompression) (Codec, bool) {
+	codecsMut.RLock()
+	defer codecsMut.RUnlock()
+	c, ok := codecs[id]
+	return c, ok
+}
+
+func init() {
+	RegisterCodec(lz4Codec{})
+	RegisterCodec(newZstdCodec())
+	RegisterCodec(snappyCodec{})
+}
+
+// defaultCodecPriority is used by connections that don't specify their own,
+// preferring zstd (better ratio at comparable CPU cost on index data) and
+// falling back to the universally supported LZ4.
+var defaultCodecPriority = []MessageCompression{MessageCompressionZstd, MessageCompressionLZ4}
+
+type lz4Codec struct{}
+
+func (lz4Codec) ID() MessageCompression { return MessageCompressionLZ4 }
+func (lz4Codec) Name() string           { return "lz4" }
+
+func (lz4Codec) Encode(src []byte) ([]byte, error) {
+	buf := BufferPool.Get(len(src))
+	buf, err := lz4.Encode(buf, src)
+	if err != nil {
+		return nil, err
+	}
+	binary.BigEndian.PutUint32(buf, binary.LittleEndian.Uint32(buf))
+	return buf, nil
+}
+
+func (lz4Codec) Decode(src []byte) ([]byte, error) {
+	size := binary.BigEndian.Uint32(src)
+	binary.LittleEndian.PutUint32(src, size)
+	buf := BufferPool.Get(int(size))
+	return lz4.Decode(buf, src)
+}
+
+// zstdCodec wraps a reusable zstd encoder/decoder pair; both are safe for
+// concurrent use, which matters since writerLoop and the reader goroutine
+// may call Encode and Decode at the same time.
+type zstdCodec struct {
+	encoder *zstd.Encoder
+	decoder *zstd.Decoder
+}
+
+func newZstdCodec() *zstdCodec {
+	enc, err := zstd.NewWriter(nil)
+	if err != nil {
+		panic("bug: failed to construct zstd encoder: " + err.Error())
+	}
+	dec, err := zstd.NewReader(nil)
+	if err != nil {
+		panic("bug: failed to construct zstd decoder: " + err.Error())
+	}
+	return &zstdCodec{encoder: enc, decoder: dec}
+}
+
+func (*zstdCodec) ID() MessageCompression { return MessageCompressionZstd }
+func (*zstdCodec) Name() string           { return "zstd" }
+
+func (c *zstdCodec) Encode(src []byte) ([]byte, error) {
+	return c.encoder.EncodeAll(src, BufferPool.Get(0)), nil
+}
+
+func (c *zstdCodec) Decode(src []byte) ([]byte, error) {
+	return c.decoder.DecodeAll(src, BufferPool.Get(0))
+}
+
+type snappyCodec struct{}
+
+func (snappyCodec) ID() MessageCompression { return MessageCompressionSnappy }
+func (snappyCodec) Name() string           { return "snappy" }
+
+func (snappyCodec) Encode(src []byte) ([]byte, error) {
+	return snappy.Encode(BufferPool.Get(snappy.MaxEncodedLen(len(src))), src), nil
+}
+
+func (snappyCodec) Decode(src []byte) ([]byte, error) {
+	n, err := snappy.DecodedLen(src)
+	if err != nil {
+		return nil, err
+	}
+	return snappy.Decode(BufferPool.Get(n), src)
 }
 
 type asyncResult struct {
@@ -193,6 +418,40 @@ type asyncMessage struct {
 	done chan struct{} // done closes when we're done sending the message
 }
 
+// messageClass buckets outgoing messages by priority, so the writer loop
+// can keep small, latency sensitive control traffic flowing even while a
+// large Response is being written.
+type messageClass int
+
+const (
+	classControl  messageClass = iota // Ping, Close, ClusterConfig, Request, RequestCancel
+	classIndex                        // Index, IndexUpdate, DownloadProgress
+	classResponse                     // Response
+	numMessageClasses
+)
+
+func classOf(msg message) messageClass {
+	switch msg.(type) {
+	case *Index, *IndexUpdate, *DownloadProgress:
+		return classIndex
+	case *Response:
+		return classResponse
+	default:
+		return classControl
+	}
+}
+
+// outboxWeights is how many messages of a class the writer loop sends, in
+// turn, before giving the next non-empty class a chance. Control traffic is
+// weighted highest so pings and ClusterConfig updates can't be head-of-line
+// blocked behind a multi-megabyte Response; response traffic is weighted
+// lowest since it's the highest volume and the least latency sensitive.
+var outboxWeights = [numMessageClasses]int{
+	classControl:  4,
+	classIndex:    2,
+	classResponse: 1,
+}
+
 const (
 	// PingSendInterval is how often we make sure to send a message, by
 	// triggering pings if necessary.
@@ -203,24 +462,88 @@ const (
 )
 
 func NewConnection(deviceID DeviceID, reader io.Reader, writer io.Writer, receiver Model, name string, compress Compression) Connection {
+	return NewConnectionWithCodecs(deviceID, reader, writer, receiver, name, compress, defaultCodecPriority)
+}
+
+// NewConnectionWithCodecs is like NewConnection but lets the caller override
+// the prioritized list of compression codecs advertised to, and preferred
+// when talking to, the peer. The first entry of codecPriority that both
+// sides support, per the codecs registered via RegisterCodec, is used for
+// outgoing messages; LZ4 is used until that negotiation completes, as all
+// supported peers understand it.
+func NewConnectionWithCodecs(deviceID DeviceID, reader io.Reader, writer io.Writer, receiver Model, name string, compress Compression, codecPriority []MessageCompression) Connection {
 	cr := &countingReader{Reader: reader}
 	cw := &countingWriter{Writer: writer}
 
+	lz4, _ := getCodec(MessageCompressionLZ4)
 	c := rawConnection{
-		id:          deviceID,
-		name:        name,
-		receiver:    nativeModel{receiver},
-		cr:          cr,
-		cw:          cw,
-		awaiting:    make(map[int32]chan asyncResult),
-		outbox:      make(chan asyncMessage),
-		closed:      make(chan struct{}),
-		compression: compress,
+		id:            deviceID,
+		name:          name,
+		receiver:      nativeModel{receiver},
+		cr:            cr,
+		cw:            cw,
+		awaiting:      make(map[int32]chan asyncResult),
+		classCredits:  outboxWeights,
+		closed:        make(chan struct{}),
+		compression:   compress,
+		codecPriority: codecPriority,
+		codec:         lz4,
+		assembling:    make(map[int32]*bytes.Buffer),
+		handling:      make(map[int32]context.CancelFunc),
+		sentStats:     newDirectionStats(),
+		recvStats:     newDirectionStats(),
+		pendingPings:  make(map[int64]time.Time),
+	}
+	for class := range c.outbox {
+		c.outbox[class] = make(chan asyncMessage)
 	}
 
 	return wireFormatConnection{&c}
 }
 
+// SetRateLimits installs token-bucket rate limiters bounding how fast this
+// connection may send and receive bytes on the wire. Either may be nil to
+// remove that direction's limit.
+func (c *rawConnection) SetRateLimits(send, recv *rate.Limiter) {
+	c.limiterMut.Lock()
+	c.sendLimiter = send
+	c.recvLimiter = recv
+	c.limiterMut.Unlock()
+}
+
+func (c *rawConnection) waitSend(n int) {
+	c.limiterMut.Lock()
+	lim := c.sendLimiter
+	c.limiterMut.Unlock()
+	waitLimiter(lim, n)
+}
+
+func (c *rawConnection) waitRecv(n int) {
+	c.limiterMut.Lock()
+	lim := c.recvLimiter
+	c.limiterMut.Unlock()
+	waitLimiter(lim, n)
+}
+
+// waitLimiter blocks until lim has n tokens available, taking them in
+// bursts of at most lim.Burst() at a time so a single large message can't
+// be rejected outright for exceeding the bucket size.
+func waitLimiter(lim *rate.Limiter, n int) {
+	if lim == nil {
+		return
+	}
+	for n > 0 {
+		take := n
+		if burst := lim.Burst(); burst > 0 && take > burst {
+			take = burst
+		}
+		if err := lim.WaitN(context.Background(), take); err != nil {
+			return
+		}
+		n -= take
+	}
+}
+
 // Start creates the goroutines for sending and receiving of messages. It must
 // be called exactly once after creating a connection.
 func (c *rawConnection) Start() {
@@ -272,6 +595,15 @@ func (c *rawConnection) IndexUpdate(folder string, idx []FileInfo) error {
 
 // Request returns the bytes for the specified block after fetching them from the connected peer.
 func (c *rawConnection) Request(folder string, name string, offset int64, size int, hash []byte, weakHash uint32, fromTemporary bool) ([]byte, error) {
+	return c.RequestContext(context.Background(), folder, name, offset, size, hash, weakHash, fromTemporary)
+}
+
+// RequestContext is like Request but abandons the request, returning
+// ctx.Err(), as soon as ctx is done. If the peer has advertised
+// CapabilityRequestCancel a RequestCancel is sent so it can stop working on
+// the block too; otherwise we just stop waiting and let any eventual
+// Response be discarded on arrival.
+func (c *rawConnection) RequestContext(ctx context.Context, folder string, name string, offset int64, size int, hash []byte, weakHash uint32, fromTemporary bool) ([]byte, error) {
 	c.nextIDMut.Lock()
 	id := c.nextID
 	c.nextID++
@@ -296,21 +628,74 @@ func (c *rawConnection) Request(folder string, name string, offset int64, size i
 		FromTemporary: fromTemporary,
 	}, nil)
 	if !ok {
+		c.awaitingMut.Lock()
+		delete(c.awaiting, id)
+		c.awaitingMut.Unlock()
 		return nil, ErrClosed
 	}
 
-	res, ok := <-rc
-	if !ok {
-		return nil, ErrClosed
+	select {
+	case res, ok := <-rc:
+		if !ok {
+			return nil, ErrClosed
+		}
+		return res.val, res.err
+
+	case <-ctx.Done():
+		// There's an inherent race here: the Response may already be on
+		// its way when we give up on it. handleResponse silently drops
+		// responses for IDs it can't find in c.awaiting, so deleting the
+		// entry first makes that race harmless.
+		c.awaitingMut.Lock()
+		delete(c.awaiting, id)
+		c.awaitingMut.Unlock()
+		if atomic.LoadUint32(&c.capabilities)&CapabilityRequestCancel != 0 {
+			c.send(&RequestCancel{ID: id}, nil)
+		}
+		return nil, ctx.Err()
 	}
-	return res.val, res.err
 }
 
 // ClusterConfig send the cluster configuration message to the peer and returns any error
 func (c *rawConnection) ClusterConfig(config ClusterConfig) {
+	config.Compression = c.advertisedCodecs()
+	config.Capabilities = supportedCapabilities
 	c.send(&config, nil)
 }
 
+// advertisedCodecs returns the names of the locally registered codecs in
+// c.codecPriority order, for inclusion in the outgoing ClusterConfig.
+func (c *rawConnection) advertisedCodecs() []string {
+	names := make([]string, 0, len(c.codecPriority))
+	for _, id := range c.codecPriority {
+		if codec, ok := getCodec(id); ok {
+			names = append(names, codec.Name())
+		}
+	}
+	return names
+}
+
+// negotiateCodec picks the most preferred codec, from c.codecPriority, that
+// the peer also advertised support for in its ClusterConfig. If there is no
+// overlap we keep using LZ4, which every supported peer understands.
+func (c *rawConnection) negotiateCodec(peerCodecs []string) {
+	supported := make(map[string]bool, len(peerCodecs))
+	for _, name := range peerCodecs {
+		supported[name] = true
+	}
+
+	for _, id := range c.codecPriority {
+		codec, ok := getCodec(id)
+		if ok && supported[codec.Name()] {
+			c.codecMut.Lock()
+			c.codec = codec
+			c.codecMut.Unlock()
+			l.Debugln(c.id, "negotiated compression codec", codec.Name())
+			return
+		}
+	}
+}
+
 func (c *rawConnection) Closed() bool {
 	select {
 	case <-c.closed:
@@ -329,7 +714,39 @@ func (c *rawConnection) DownloadProgress(folder string, updates []FileDownloadPr
 }
 
 func (c *rawConnection) ping() bool {
-	return c.send(&Ping{}, nil)
+	ping := &Ping{}
+	if atomic.LoadUint32(&c.capabilities)&CapabilityPingRTT != 0 {
+		nonce := atomic.AddInt64(&c.pingNonce, 1)
+		ping.Nonce = nonce
+		c.rttMut.Lock()
+		c.pendingPings[nonce] = time.Now()
+		c.rttMut.Unlock()
+	}
+	return c.send(ping, nil)
+}
+
+// pingRTTWeight controls how quickly Statistics().RTT reacts to a new
+// Ping/Pong sample; each sample contributes this fraction of the new
+// moving average, smoothing out jitter from any single round trip.
+const pingRTTWeight = 0.2
+
+func (c *rawConnection) handlePong(msg Pong) {
+	c.rttMut.Lock()
+	defer c.rttMut.Unlock()
+
+	sent, ok := c.pendingPings[msg.Nonce]
+	if !ok {
+		// Unknown or already handled nonce; ignore.
+		return
+	}
+	delete(c.pendingPings, msg.Nonce)
+
+	sample := time.Since(sent)
+	if c.rtt == 0 {
+		c.rtt = sample
+	} else {
+		c.rtt = time.Duration((1-pingRTTWeight)*float64(c.rtt) + pingRTTWeight*float64(sample))
+	}
 }
 
 func (c *rawConnection) readerLoop() (err error) {
@@ -362,6 +779,8 @@ func (c *rawConnection) readerLoop() (err error) {
 				return fmt.Errorf("protocol error: cluster config message in state %d", state)
 			}
 			c.receiver.ClusterConfig(c.id, *msg)
+			c.negotiateCodec(msg.Compression)
+			atomic.StoreUint32(&c.capabilities, msg.Capabilities&supportedCapabilities)
 			state = stateReady
 
 		case *Index:
@@ -396,6 +815,13 @@ func (c *rawConnection) readerLoop() (err error) {
 			}
 			go c.handleRequest(*msg)
 
+		case *RequestCancel:
+			l.Debugln("read RequestCancel message")
+			if state != stateReady {
+				return fmt.Errorf("protocol error: request cancel message in state %d", state)
+			}
+			c.handleRequestCancel(*msg)
+
 		case *Response:
 			l.Debugln("read Response message")
 			if state != stateReady {
@@ -415,7 +841,17 @@ func (c *rawConnection) readerLoop() (err error) {
 			if state != stateReady {
 				return fmt.Errorf("protocol error: ping message in state %d", state)
 			}
-			// Nothing
+			if msg.Nonce != 0 {
+				// The peer wants this echoed back so it can measure RTT.
+				c.send(&Pong{Nonce: msg.Nonce}, nil)
+			}
+
+		case *Pong:
+			l.Debugln("read Pong message")
+			if state != stateReady {
+				return fmt.Errorf("protocol error: pong message in state %d", state)
+			}
+			c.handlePong(*msg)
 
 		case *Close:
 			l.Debugln("read Close message")
@@ -450,10 +886,12 @@ func (c *rawConnection) readMessageAfterHeader(hdr Header, fourByteBuf []byte) (
 
 	// Then comes the message
 
+	c.waitRecv(int(msgLen))
 	buf := BufferPool.Get(int(msgLen))
 	if _, err := io.ReadFull(c.cr, buf); err != nil {
 		return nil, fmt.Errorf("reading message: %v", err)
 	}
+	onWireBytes := len(buf)
 
 	// ... which might be compressed
 
@@ -461,16 +899,18 @@ func (c *rawConnection) readMessageAfterHeader(hdr Header, fourByteBuf []byte) (
 	case MessageCompressionNone:
 		// Nothing
 
-	case MessageCompressionLZ4:
-		decomp, err := c.lz4Decompress(buf)
+	default:
+		codec, ok := getCodec(hdr.Compression)
+		if !ok {
+			return nil, fmt.Errorf("unknown message compression %d", hdr.Compression)
+		}
+		decomp, err := codec.Decode(buf)
 		BufferPool.Put(buf)
 		if err != nil {
+			atomic.AddInt64(&c.decompressionErrors, 1)
 			return nil, fmt.Errorf("decompressing message: %v", err)
 		}
 		buf = decomp
-
-	default:
-		return nil, fmt.Errorf("unknown message compression %d", hdr.Compression)
 	}
 
 	// ... and is then unmarshalled
@@ -484,6 +924,8 @@ func (c *rawConnection) readMessageAfterHeader(hdr Header, fourByteBuf []byte) (
 	}
 	BufferPool.Put(buf)
 
+	c.recvStats.record(hdr.Type, onWireBytes)
+
 	return msg, nil
 }
 
@@ -587,25 +1029,102 @@ func checkFilename(name string) error {
 }
 
 func (c *rawConnection) handleRequest(req Request) {
-	res, err := c.receiver.Request(c.id, req.Folder, req.Name, req.Size, req.Offset, req.Hash, req.WeakHash, req.FromTemporary)
+	ctx, cancel := context.WithCancel(context.Background())
+	c.handlingMut.Lock()
+	c.handling[req.ID] = cancel
+	c.handlingMut.Unlock()
+	defer func() {
+		c.handlingMut.Lock()
+		delete(c.handling, req.ID)
+		c.handlingMut.Unlock()
+		cancel()
+	}()
+
+	res, err := c.receiver.Request(ctx, c.id, req.Folder, req.Name, req.Size, req.Offset, req.Hash, req.WeakHash, req.FromTemporary)
 	if err != nil {
+		if ctx.Err() != nil {
+			// The requester already gave up on this one; no point
+			// spending a Response message on it.
+			return
+		}
 		c.send(&Response{
 			ID:   req.ID,
 			Code: errorToCode(err),
 		}, nil)
 		return
 	}
-	done := make(chan struct{})
-	c.send(&Response{
-		ID:   req.ID,
-		Data: res.Data(),
-		Code: errorToCode(nil),
-	}, done)
-	<-done
+
+	data := res.Data()
+	chunked := atomic.LoadUint32(&c.capabilities)&CapabilityChunkedResponse != 0
+	if !chunked || len(data) <= responseChunkSize {
+		done := make(chan struct{})
+		c.send(&Response{
+			ID:   req.ID,
+			Data: data,
+			Code: errorToCode(nil),
+		}, done)
+		<-done
+		res.Close()
+		return
+	}
+
+	// The peer supports chunked responses and the block is large enough to
+	// benefit: split it into bounded frames so a big Response doesn't
+	// monopolize the outbox ahead of smaller, higher priority messages.
+	for offset := 0; offset < len(data); offset += responseChunkSize {
+		end := offset + responseChunkSize
+		if end > len(data) {
+			end = len(data)
+		}
+		var flags uint32
+		if end < len(data) {
+			flags = ResponseMoreComing
+		}
+		done := make(chan struct{})
+		c.send(&Response{
+			ID:    req.ID,
+			Data:  data[offset:end],
+			Code:  errorToCode(nil),
+			Flags: flags,
+		}, done)
+		<-done
+	}
 	res.Close()
 }
 
+// handleRequestCancel stops an in-progress handleRequest for the given
+// request ID, if we're still working on it. If it already finished (or
+// never existed, e.g. duplicate/late cancel) this is a no-op.
+func (c *rawConnection) handleRequestCancel(msg RequestCancel) {
+	c.handlingMut.Lock()
+	cancel, ok := c.handling[msg.ID]
+	c.handlingMut.Unlock()
+	if ok {
+		cancel()
+	}
+}
+
 func (c *rawConnection) handleResponse(resp Response) {
+	if resp.Flags&ResponseMoreComing != 0 {
+		c.assemblingMut.Lock()
+		buf, ok := c.assembling[resp.ID]
+		if !ok {
+			buf = new(bytes.Buffer)
+			c.assembling[resp.ID] = buf
+		}
+		buf.Write(resp.Data)
+		c.assemblingMut.Unlock()
+		return
+	}
+
+	c.assemblingMut.Lock()
+	if buf, ok := c.assembling[resp.ID]; ok {
+		buf.Write(resp.Data)
+		resp.Data = buf.Bytes()
+		delete(c.assembling, resp.ID)
+	}
+	c.assemblingMut.Unlock()
+
 	c.awaitingMut.Lock()
 	if rc := c.awaiting[resp.ID]; rc != nil {
 		delete(c.awaiting, resp.ID)
@@ -616,10 +1135,12 @@ func (c *rawConnection) handleResponse(resp Response) {
 }
 
 func (c *rawConnection) send(msg message, done chan struct{}) bool {
+	atomic.AddInt64(&c.outboxDepth, 1)
 	select {
-	case c.outbox <- asyncMessage{msg, done}:
+	case c.outbox[classOf(msg)] <- asyncMessage{msg, done}:
 		return true
 	case <-c.closed:
+		atomic.AddInt64(&c.outboxDepth, -1)
 		if done != nil {
 			close(done)
 		}
@@ -629,20 +1150,62 @@ func (c *rawConnection) send(msg message, done chan struct{}) bool {
 
 func (c *rawConnection) writerLoop() {
 	for {
-		select {
-		case hm := <-c.outbox:
-			err := c.writeMessage(hm)
-			if hm.done != nil {
-				close(hm.done)
+		hm, ok := c.nextOutgoing()
+		if !ok {
+			return
+		}
+		err := c.writeMessage(hm)
+		if hm.done != nil {
+			close(hm.done)
+		}
+		if err != nil {
+			c.close(err)
+			return
+		}
+	}
+}
+
+// nextOutgoing picks the next message to write using weighted fair
+// queueing across the outbox classes (see outboxWeights): each class may be
+// drained up to its remaining credit before ceding to the next one, so a
+// backlog of large Responses can't starve control or index traffic. Credits
+// are replenished once nothing is immediately available within budget.
+func (c *rawConnection) nextOutgoing() (asyncMessage, bool) {
+	for {
+		for class := messageClass(0); class < numMessageClasses; class++ {
+			if c.classCredits[class] <= 0 {
+				continue
 			}
-			if err != nil {
-				c.close(err)
-				return
+			select {
+			case hm := <-c.outbox[class]:
+				c.classCredits[class]--
+				atomic.AddInt64(&c.outboxDepth, -1)
+				return hm, true
+			case <-c.closed:
+				return asyncMessage{}, false
+			default:
 			}
+		}
 
+		// Nothing ready within the current credit budget. Reset it and
+		// fall back to a blocking wait across every class so we don't
+		// busy-loop while the connection is idle.
+		c.classCredits = outboxWeights
+		var hm asyncMessage
+		var class messageClass
+		select {
+		case hm = <-c.outbox[classControl]:
+			class = classControl
+		case hm = <-c.outbox[classIndex]:
+			class = classIndex
+		case hm = <-c.outbox[classResponse]:
+			class = classResponse
 		case <-c.closed:
-			return
+			return asyncMessage{}, false
 		}
+		c.classCredits[class]--
+		atomic.AddInt64(&c.outboxDepth, -1)
+		return hm, true
 	}
 }
 
@@ -660,14 +1223,18 @@ func (c *rawConnection) writeCompressedMessage(hm asyncMessage) error {
 		return fmt.Errorf("marshalling message: %v", err)
 	}
 
-	compressed, err := c.lz4Compress(buf)
+	c.codecMut.Lock()
+	codec := c.codec
+	c.codecMut.Unlock()
+
+	compressed, err := codec.Encode(buf)
 	if err != nil {
 		return fmt.Errorf("compressing message: %v", err)
 	}
 
 	hdr := Header{
 		Type:        c.typeOf(hm.msg),
-		Compression: MessageCompressionLZ4,
+		Compression: codec.ID(),
 	}
 	hdrSize := hdr.ProtoSize()
 	if hdrSize > 1<<16-1 {
@@ -689,6 +1256,7 @@ func (c *rawConnection) writeCompressedMessage(hm asyncMessage) error {
 	copy(buf[2+hdrSize+4:], compressed)
 	BufferPool.Put(compressed)
 
+	c.waitSend(len(buf))
 	n, err := c.cw.Write(buf)
 	BufferPool.Put(buf)
 
@@ -696,6 +1264,10 @@ func (c *rawConnection) writeCompressedMessage(hm asyncMessage) error {
 	if err != nil {
 		return fmt.Errorf("writing message: %v", err)
 	}
+
+	atomic.AddInt64(&c.rawBytesOut, int64(size))
+	atomic.AddInt64(&c.compressedBytesOut, int64(len(compressed)))
+	c.sentStats.record(hdr.Type, n)
 	return nil
 }
 
@@ -726,6 +1298,7 @@ func (c *rawConnection) writeUncompressedMessage(hm asyncMessage) error {
 		return fmt.Errorf("marshalling message: %v", err)
 	}
 
+	c.waitSend(totSize)
 	n, err := c.cw.Write(buf[:totSize])
 	BufferPool.Put(buf)
 
@@ -733,6 +1306,8 @@ func (c *rawConnection) writeUncompressedMessage(hm asyncMessage) error {
 	if err != nil {
 		return fmt.Errorf("writing message: %v", err)
 	}
+
+	c.sentStats.record(hdr.Type, n)
 	return nil
 }
 
@@ -746,12 +1321,16 @@ func (c *rawConnection) typeOf(msg message) MessageType {
 		return messageTypeIndexUpdate
 	case *Request:
 		return messageTypeRequest
+	case *RequestCancel:
+		return messageTypeRequestCancel
 	case *Response:
 		return messageTypeResponse
 	case *DownloadProgress:
 		return messageTypeDownloadProgress
 	case *Ping:
 		return messageTypePing
+	case *Pong:
+		return messageTypePong
 	case *Close:
 		return messageTypeClose
 	default:
@@ -769,12 +1348,16 @@ func (c *rawConnection) newMessage(t MessageType) (message, error) {
 		return new(IndexUpdate), nil
 	case messageTypeRequest:
 		return new(Request), nil
+	case messageTypeRequestCancel:
+		return new(RequestCancel), nil
 	case messageTypeResponse:
 		return new(Response), nil
 	case messageTypeDownloadProgress:
 		return new(DownloadProgress), nil
 	case messageTypePing:
 		return new(Ping), nil
+	case messageTypePong:
+		return new(Pong), nil
 	case messageTypeClose:
 		return new(Close), nil
 	default:
@@ -815,6 +1398,19 @@ func (c *rawConnection) close(err error) {
 		}
 		c.awaitingMut.Unlock()
 
+		c.assemblingMut.Lock()
+		for i := range c.assembling {
+			delete(c.assembling, i)
+		}
+		c.assemblingMut.Unlock()
+
+		c.handlingMut.Lock()
+		for i, cancel := range c.handling {
+			cancel()
+			delete(c.handling, i)
+		}
+		c.handlingMut.Unlock()
+
 		c.receiver.Closed(c, err)
 	})
 }
@@ -870,40 +1466,110 @@ func (c *rawConnection) pingReceiver() {
 	}
 }
 
+// MessageTypeStats is a point-in-time snapshot of the counters for a single
+// message type, in a single direction (sent or received).
+type MessageTypeStats struct {
+	Count int64
+	Bytes int64
+}
+
+// directionStats accumulates per message type counters for one direction
+// (sent or received) of a connection.
+type directionStats struct {
+	mut    sync.Mutex
+	byType map[MessageType]*messageTypeCounters
+}
+
+type messageTypeCounters struct {
+	count int64 // atomic
+	bytes int64 // atomic
+}
+
+func newDirectionStats() *directionStats {
+	return &directionStats{byType: make(map[MessageType]*messageTypeCounters)}
+}
+
+func (d *directionStats) record(t MessageType, n int) {
+	d.mut.Lock()
+	s, ok := d.byType[t]
+	if !ok {
+		s = &messageTypeCounters{}
+		d.byType[t] = s
+	}
+	d.mut.Unlock()
+	atomic.AddInt64(&s.count, 1)
+	atomic.AddInt64(&s.bytes, int64(n))
+}
+
+func (d *directionStats) snapshot() map[MessageType]MessageTypeStats {
+	d.mut.Lock()
+	defer d.mut.Unlock()
+	out := make(map[MessageType]MessageTypeStats, len(d.byType))
+	for t, s := range d.byType {
+		out[t] = MessageTypeStats{
+			Count: atomic.LoadInt64(&s.count),
+			Bytes: atomic.LoadInt64(&s.bytes),
+		}
+	}
+	return out
+}
+
 type Statistics struct {
 	At            time.Time
 	InBytesTotal  int64
 	OutBytesTotal int64
+
+	// Sent and Received break traffic down by message type.
+	Sent     map[MessageType]MessageTypeStats
+	Received map[MessageType]MessageTypeStats
+
+	// CompressionRatio is the ratio of uncompressed to compressed bytes
+	// across messages sent compressed on this connection, or 0 if none
+	// have been sent yet.
+	CompressionRatio float64
+
+	// OutboxDepth is the number of messages currently queued to be
+	// written, across all priority classes.
+	OutboxDepth int
+
+	// InFlightRequests is the number of Requests we've sent that are still
+	// awaiting a Response.
+	InFlightRequests int
+
+	// RTT is an exponential moving average of the round-trip time derived
+	// from the Ping/Pong nonce exchange, or 0 if that hasn't completed yet
+	// (e.g. the peer doesn't advertise CapabilityPingRTT).
+	RTT time.Duration
+
+	// DecompressionErrors is the number of times a received message on
+	// this connection failed to decompress.
+	DecompressionErrors int64
 }
 
 func (c *rawConnection) Statistics() Statistics {
-	return Statistics{
-		At:            time.Now(),
-		InBytesTotal:  c.cr.Tot(),
-		OutBytesTotal: c.cw.Tot(),
+	var ratio float64
+	if raw := atomic.LoadInt64(&c.rawBytesOut); raw > 0 {
+		ratio = float64(raw) / float64(atomic.LoadInt64(&c.compressedBytesOut))
 	}
-}
 
-func (c *rawConnection) lz4Compress(src []byte) ([]byte, error) {
-	var err error
-	buf := BufferPool.Get(len(src))
-	buf, err = lz4.Encode(buf, src)
-	if err != nil {
-		return nil, err
-	}
+	c.awaitingMut.Lock()
+	inFlight := len(c.awaiting)
+	c.awaitingMut.Unlock()
 
-	binary.BigEndian.PutUint32(buf, binary.LittleEndian.Uint32(buf))
-	return buf, nil
-}
+	c.rttMut.Lock()
+	rtt := c.rtt
+	c.rttMut.Unlock()
 
-func (c *rawConnection) lz4Decompress(src []byte) ([]byte, error) {
-	size := binary.BigEndian.Uint32(src)
-	binary.LittleEndian.PutUint32(src, size)
-	var err error
-	buf := BufferPool.Get(int(size))
-	buf, err = lz4.Decode(buf, src)
-	if err != nil {
-		return nil, err
+	return Statistics{
+		At:                  time.Now(),
+		InBytesTotal:        c.cr.Tot(),
+		OutBytesTotal:       c.cw.Tot(),
+		Sent:                c.sentStats.snapshot(),
+		Received:            c.recvStats.snapshot(),
+		CompressionRatio:    ratio,
+		OutboxDepth:         int(atomic.LoadInt64(&c.outboxDepth)),
+		InFlightRequests:    inFlight,
+		RTT:                 rtt,
+		DecompressionErrors: atomic.LoadInt64(&c.decompressionErrors),
 	}
-	return buf, nil
 }
@@ -0,0 +1,81 @@
+// Copyright (C) 2014 The Protocol Authors.
+
+package protocol
+
+import (
+	"context"
+	"testing"
+)
+
+// TestRequestContextCancelRemovesAwaitingEntry checks that giving up on a
+// RequestContext call via ctx doesn't leak its entry in c.awaiting; a leak
+// there would accumulate one blocked goroutine's worth of channel per
+// cancelled request for the lifetime of the connection.
+func TestRequestContextCancelRemovesAwaitingEntry(t *testing.T) {
+	c := newTestRawConnection(16)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel() // already cancelled: RequestContext must give up immediately
+
+	if _, err := c.RequestContext(ctx, "folder", "file", 0, 128, nil, 0, false); err != ctx.Err() {
+		t.Fatalf("RequestContext() error = %v, want %v", err, ctx.Err())
+	}
+
+	c.awaitingMut.Lock()
+	n := len(c.awaiting)
+	c.awaitingMut.Unlock()
+	if n != 0 {
+		t.Fatalf("awaiting has %d entries after cancellation, want 0", n)
+	}
+}
+
+// TestHandleResponseIgnoresLateResponseAfterCancel covers the documented
+// race between RequestContext giving up on ctx.Done and a Response for the
+// same ID arriving right after: handleResponse must drop it rather than
+// resurrect the awaiting entry or panic.
+func TestHandleResponseIgnoresLateResponseAfterCancel(t *testing.T) {
+	c := newTestRawConnection(16)
+
+	const id = int32(42)
+	c.awaiting[id] = make(chan asyncResult, 1)
+	// Simulate RequestContext having already cleaned up after ctx.Done.
+	delete(c.awaiting, id)
+
+	c.handleResponse(Response{ID: id, Data: []byte("late")})
+
+	c.awaitingMut.Lock()
+	_, stillThere := c.awaiting[id]
+	c.awaitingMut.Unlock()
+	if stillThere {
+		t.Fatalf("awaiting[%d] resurrected by a Response for a cancelled request", id)
+	}
+}
+
+// TestHandleResponseChunkedAssemblyDropsAfterCancel checks that a chunked
+// Response whose final chunk arrives after the requester has already given
+// up doesn't leave its partial buffer in c.assembling once that final
+// chunk is seen.
+func TestHandleResponseChunkedAssemblyDropsAfterCancel(t *testing.T) {
+	c := newTestRawConnection(16)
+
+	const id = int32(7)
+	c.handleResponse(Response{ID: id, Data: []byte("part1"), Flags: ResponseMoreComing})
+
+	c.assemblingMut.Lock()
+	_, inProgress := c.assembling[id]
+	c.assemblingMut.Unlock()
+	if !inProgress {
+		t.Fatalf("assembling[%d] missing after first chunk", id)
+	}
+
+	// The requester gave up on this ID in the meantime; awaiting has
+	// nothing for it, but the final chunk should still clear assembling.
+	c.handleResponse(Response{ID: id, Data: []byte("part2")})
+
+	c.assemblingMut.Lock()
+	_, stillThere := c.assembling[id]
+	c.assemblingMut.Unlock()
+	if stillThere {
+		t.Fatalf("assembling[%d] leaked after final chunk of a cancelled request", id)
+	}
+}
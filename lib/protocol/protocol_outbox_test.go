@@ -0,0 +1,76 @@
+// Copyright (C) 2014 The Protocol Authors.
+
+package protocol
+
+import (
+	"bytes"
+	"context"
+	"math"
+	"testing"
+	"time"
+)
+
+// newTestRawConnection returns a rawConnection with just enough state
+// initialized to exercise its internal scheduling and bookkeeping, without
+// going through NewConnectionWithCodecs (which requires a real reader/writer
+// pair and starts goroutines via Start). outboxBuffer sizes each outbox
+// channel's buffer so callers that fill a class to completion before
+// draining it (as TestNextOutgoingRespectsWeights does) don't deadlock.
+func newTestRawConnection(outboxBuffer int) *rawConnection {
+	c := &rawConnection{
+		awaiting:     make(map[int32]chan asyncResult),
+		classCredits: outboxWeights,
+		closed:       make(chan struct{}),
+		assembling:   make(map[int32]*bytes.Buffer),
+		handling:     make(map[int32]context.CancelFunc),
+		sentStats:    newDirectionStats(),
+		recvStats:    newDirectionStats(),
+		pendingPings: make(map[int64]time.Time),
+	}
+	for class := range c.outbox {
+		c.outbox[class] = make(chan asyncMessage, outboxBuffer)
+	}
+	return c
+}
+
+// TestNextOutgoingRespectsWeights pins down the weighted fair queueing
+// contract in outboxWeights: with all three classes permanently backlogged,
+// each class's share of delivered messages should track its weight,
+// including the messages handed out by the "nothing ready within budget"
+// fallback branch of nextOutgoing. A fallback read that forgets to charge
+// the class it served lets that class exceed its configured share.
+func TestNextOutgoingRespectsWeights(t *testing.T) {
+	const perClass = 2800
+	c := newTestRawConnection(perClass)
+
+	fill := func(class messageClass, msg message) {
+		for i := 0; i < perClass; i++ {
+			c.outbox[class] <- asyncMessage{msg: msg}
+		}
+	}
+	fill(classControl, &ClusterConfig{})
+	fill(classIndex, &Index{})
+	fill(classResponse, &Response{})
+
+	var counts [numMessageClasses]int
+	// Stop after perClass draws: even the highest weighted class (4/7 of
+	// draws) is then still backlogged, so no class ever runs dry.
+	draws := perClass
+	for i := 0; i < draws; i++ {
+		hm, ok := c.nextOutgoing()
+		if !ok {
+			t.Fatalf("nextOutgoing() reported closed at draw %d", i)
+		}
+		counts[classOf(hm.msg)]++
+	}
+
+	totalWeight := outboxWeights[classControl] + outboxWeights[classIndex] + outboxWeights[classResponse]
+	const tolerance = 0.01
+	for class, want := range outboxWeights {
+		wantShare := float64(want) / float64(totalWeight)
+		gotShare := float64(counts[class]) / float64(draws)
+		if math.Abs(gotShare-wantShare) > tolerance {
+			t.Errorf("class %d share = %.3f, want ~%.3f (weight %d/%d)", class, gotShare, wantShare, want, totalWeight)
+		}
+	}
+}